@@ -0,0 +1,278 @@
+package errors
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// asyncReporterRingSize bounds both the ring buffer DebugHandler reads
+	// from and the channel feeding the delivery goroutine.
+	asyncReporterRingSize = 200
+
+	// sampleBucketCapacity and sampleBucketRefill configure the token
+	// bucket keyed by (GoPackage, GoType, Op, Desc): a burst of up to
+	// sampleBucketCapacity identical errors reports each one, after which
+	// they collapse to a single report every 1/sampleBucketRefill seconds
+	// with a running count attached.
+	sampleBucketCapacity = 3
+	sampleBucketRefill   = 1.0 / 60 // one fresh token per minute per key
+
+	asyncReportMaxAttempts = 5
+	asyncReportMinBackoff  = 200 * time.Millisecond
+	asyncReportMaxBackoff  = 30 * time.Second
+)
+
+// AsyncReporter wraps another Reporter so that Report never blocks the
+// caller: every error is recorded in a bounded ring buffer (so DebugHandler
+// can serve recent history) and, unless the sampler judges it a repeat,
+// handed to a background goroutine that delivers it to the wrapped Reporter
+// with retries and exponential backoff.
+type AsyncReporter struct {
+	wrapped  Reporter
+	sampler  *sampler
+	incoming chan *Error
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	ring    []*Error
+	dropped int64
+}
+
+// NewAsyncReporter starts a background goroutine delivering to wrapped and
+// returns a Reporter that can be installed via ReportTo.
+func NewAsyncReporter(wrapped Reporter) *AsyncReporter {
+	r := &AsyncReporter{
+		wrapped:  wrapped,
+		sampler:  newSampler(sampleBucketCapacity, sampleBucketRefill),
+		incoming: make(chan *Error, asyncReporterRingSize),
+		stop:     make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.loop()
+	return r
+}
+
+// Report records e in the ring buffer and, subject to sampling, queues it
+// for delivery. It never blocks: if the delivery queue is full, e is
+// dropped and counted so the next delivered error reports how many were
+// lost in its Extra["droppedErrors"] field.
+func (r *AsyncReporter) Report(e *Error) error {
+	r.appendRing(e)
+	if !r.sampler.allow(e) {
+		return nil
+	}
+	select {
+	case r.incoming <- e:
+	default:
+		r.mu.Lock()
+		r.dropped++
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// appendRing stores a clone of e, not e itself: e is about to be passed to
+// sampler.allow and, later, deliver, both of which mutate e.Extra. Without
+// cloning, those mutations would race with debugSnapshot's unlocked
+// json.Marshal of the same *Error read out of the ring.
+func (r *AsyncReporter) appendRing(e *Error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ring = append(r.ring, cloneError(e))
+	if len(r.ring) > asyncReporterRingSize {
+		r.ring = r.ring[len(r.ring)-asyncReporterRingSize:]
+	}
+}
+
+// cloneError returns a shallow copy of e with its own Extra map, so the copy
+// can be read (e.g. serialized) concurrently with later mutations to e.Extra.
+func cloneError(e *Error) *Error {
+	clone := *e
+	if e.Extra != nil {
+		clone.Extra = make(map[string]string, len(e.Extra))
+		for k, v := range e.Extra {
+			clone.Extra[k] = v
+		}
+	}
+	return &clone
+}
+
+func (r *AsyncReporter) loop() {
+	defer r.wg.Done()
+	for {
+		select {
+		case e := <-r.incoming:
+			r.deliver(e)
+		case <-r.stop:
+			// Drain whatever was already queued before exiting.
+			for {
+				select {
+				case e := <-r.incoming:
+					r.deliver(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *AsyncReporter) deliver(e *Error) {
+	r.mu.Lock()
+	if r.dropped > 0 {
+		if e.Extra == nil {
+			e.Extra = map[string]string{}
+		}
+		e.Extra["droppedErrors"] = strconv.FormatInt(r.dropped, 10)
+		r.dropped = 0
+	}
+	r.mu.Unlock()
+
+	backoff := asyncReportMinBackoff
+	for attempt := 0; attempt < asyncReportMaxAttempts; attempt++ {
+		if err := r.wrapped.Report(e); err == nil {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-r.stop:
+			return
+		}
+		backoff *= 2
+		if backoff > asyncReportMaxBackoff {
+			backoff = asyncReportMaxBackoff
+		}
+	}
+}
+
+// Close stops accepting new deliveries, drains whatever is already queued
+// into the wrapped Reporter (best-effort, bounded by ctx), and closes the
+// wrapped Reporter.
+func (r *AsyncReporter) Close(ctx context.Context) error {
+	close(r.stop)
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	return r.wrapped.Close(ctx)
+}
+
+// debugSnapshot is what DebugHandler serves: recent errors plus a couple of
+// aggregate breakdowns the UI can render without re-deriving them.
+type debugSnapshot struct {
+	Errors           []*Error       `json:"errors"`
+	CountByGoType    map[string]int `json:"countByGoType"`
+	CountByProxyType map[string]int `json:"countByProxyType"`
+}
+
+func (r *AsyncReporter) debugSnapshot() debugSnapshot {
+	r.mu.Lock()
+	errs := append([]*Error{}, r.ring...)
+	r.mu.Unlock()
+
+	snap := debugSnapshot{
+		Errors:           errs,
+		CountByGoType:    map[string]int{},
+		CountByProxyType: map[string]int{},
+	}
+	for _, e := range errs {
+		snap.CountByGoType[e.GoType]++
+		if e.ProxyingInfo != nil {
+			snap.CountByProxyType[string(e.ProxyingInfo.ProxyType)]++
+		}
+	}
+	return snap
+}
+
+// DebugHandler serves the last errors recorded by the currently active
+// AsyncReporter, plus aggregate counts by GoType and ProxyType, as JSON --
+// for a desktop UI diagnostics panel. It responds 503 if the current
+// reporter isn't an AsyncReporter.
+func DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		async, ok := currentReporter.(*AsyncReporter)
+		if !ok {
+			http.Error(w, "async reporter not active", http.StatusServiceUnavailable)
+			return
+		}
+		b, err := json.Marshal(async.debugSnapshot())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(b)
+	})
+}
+
+// sampler is a token bucket per (GoPackage, GoType, Op, Desc) key. allow
+// consumes a token and returns true if one was available; otherwise it
+// records the error as suppressed and returns false. The next allowed
+// report for that key gets a running count attached so nothing is silently
+// lost, just collapsed.
+type sampler struct {
+	capacity float64
+	refill   float64 // tokens per second
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens     float64
+	lastRefill time.Time
+	suppressed int
+}
+
+func newSampler(capacity, refillPerSecond float64) *sampler {
+	return &sampler{capacity: capacity, refill: refillPerSecond, buckets: map[string]*bucket{}}
+}
+
+func sampleKey(e *Error) string {
+	return strings.Join([]string{e.GoPackage, e.GoType, string(e.Op), e.Desc}, "\x00")
+}
+
+func (s *sampler) allow(e *Error) bool {
+	key := sampleKey(e)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: s.capacity, lastRefill: now}
+		s.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.lastRefill).Seconds() * s.refill
+	if b.tokens > s.capacity {
+		b.tokens = s.capacity
+	}
+	b.lastRefill = now
+
+	if b.tokens < 1 {
+		b.suppressed++
+		return false
+	}
+	b.tokens--
+	if b.suppressed > 0 {
+		if e.Extra == nil {
+			e.Extra = map[string]string{}
+		}
+		e.Extra["sampledCount"] = strconv.Itoa(b.suppressed + 1)
+		b.suppressed = 0
+	}
+	return true
+}
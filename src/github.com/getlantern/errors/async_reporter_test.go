@@ -0,0 +1,174 @@
+package errors
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingReporter is a Reporter test double that records every delivered
+// Error so tests can assert on what (and how many) actually got through.
+type countingReporter struct {
+	mu      sync.Mutex
+	reports []*Error
+}
+
+func (r *countingReporter) Report(e *Error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reports = append(r.reports, e)
+	return nil
+}
+
+func (r *countingReporter) Close(ctx context.Context) error { return nil }
+
+func (r *countingReporter) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.reports)
+}
+
+// blockingReporter never returns from Report until release is closed, used
+// to back up AsyncReporter's delivery queue on demand.
+type blockingReporter struct {
+	release chan struct{}
+}
+
+func (r *blockingReporter) Report(e *Error) error {
+	<-r.release
+	return nil
+}
+
+func (r *blockingReporter) Close(ctx context.Context) error { return nil }
+
+func TestAsyncReporterRingBufferBounded(t *testing.T) {
+	async := NewAsyncReporter(&countingReporter{})
+	defer async.Close(context.Background())
+
+	const total = asyncReporterRingSize * 2
+	for i := 0; i < total; i++ {
+		async.appendRing(&Error{Desc: fmt.Sprintf("e-%d", i)})
+	}
+
+	snap := async.debugSnapshot()
+	if len(snap.Errors) != asyncReporterRingSize {
+		t.Fatalf("expected ring buffer capped at %d entries, got %d", asyncReporterRingSize, len(snap.Errors))
+	}
+	if last := snap.Errors[len(snap.Errors)-1].Desc; last != fmt.Sprintf("e-%d", total-1) {
+		t.Fatalf("expected ring buffer to retain the most recent entries, last was %q", last)
+	}
+}
+
+func TestAsyncReporterDropsAndCountsOnBackpressure(t *testing.T) {
+	wrapped := &blockingReporter{release: make(chan struct{})}
+	async := NewAsyncReporter(wrapped)
+
+	// Each report uses a distinct key so the sampler's per-key token bucket
+	// never suppresses any of them -- every call queues for delivery. The
+	// delivery goroutine picks up the first and blocks on wrapped.release,
+	// so the rest pile up against incoming's bounded capacity and overflow.
+	const total = asyncReporterRingSize + 50
+	for i := 0; i < total; i++ {
+		async.Report(&Error{GoPackage: "pkg", GoType: "type", Desc: fmt.Sprintf("err-%d", i)})
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		async.mu.Lock()
+		dropped := async.dropped
+		async.mu.Unlock()
+		if dropped > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected some reports to be dropped once the delivery queue filled up, got 0")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(wrapped.release)
+	if err := async.Close(context.Background()); err != nil {
+		t.Fatalf("Close returned an error: %v", err)
+	}
+}
+
+func TestAsyncReporterRetriesBeforeSucceeding(t *testing.T) {
+	wrapped := &flakyReporter{failuresRemaining: 2}
+	async := NewAsyncReporter(wrapped)
+
+	async.Report(&Error{GoPackage: "pkg", GoType: "type", Desc: "retry-me"})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for wrapped.successCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the error to eventually be delivered after retries")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := async.Close(context.Background()); err != nil {
+		t.Fatalf("Close returned an error: %v", err)
+	}
+}
+
+// flakyReporter fails Report a fixed number of times before succeeding, so
+// tests can exercise AsyncReporter's retry-with-backoff path.
+type flakyReporter struct {
+	mu                sync.Mutex
+	failuresRemaining int
+	successes         int
+}
+
+func (r *flakyReporter) Report(e *Error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failuresRemaining > 0 {
+		r.failuresRemaining--
+		return fmt.Errorf("synthetic failure")
+	}
+	r.successes++
+	return nil
+}
+
+func (r *flakyReporter) Close(ctx context.Context) error { return nil }
+
+func (r *flakyReporter) successCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.successes
+}
+
+func TestSamplerAllowsBurstThenSuppresses(t *testing.T) {
+	s := newSampler(3, 0)
+	e := &Error{GoPackage: "p", GoType: "t", Desc: "d"}
+
+	for i := 0; i < 3; i++ {
+		if !s.allow(e) {
+			t.Fatalf("expected burst token %d to be allowed", i)
+		}
+	}
+	if s.allow(e) {
+		t.Fatalf("expected burst capacity to be exhausted")
+	}
+}
+
+func TestSamplerReportsSampledCountAfterSuppression(t *testing.T) {
+	s := newSampler(1, 1000) // fast refill so the next allow succeeds almost immediately
+	e := &Error{GoPackage: "p", GoType: "t", Desc: "d"}
+
+	if !s.allow(e) {
+		t.Fatalf("expected the first call to be allowed")
+	}
+	if s.allow(e) {
+		t.Fatalf("expected the second call to be suppressed before refill")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if !s.allow(e) {
+		t.Fatalf("expected a call to be allowed again once the bucket refilled")
+	}
+	if e.Extra["sampledCount"] != "2" {
+		t.Fatalf("expected sampledCount to cover the 1 suppressed call plus this one, got %q", e.Extra["sampledCount"])
+	}
+}
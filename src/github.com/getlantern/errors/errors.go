@@ -13,10 +13,12 @@ package errors
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"io"
 	"net"
@@ -72,6 +74,23 @@ const (
 	DirectFrontedProxy ProxyType = "DDF"
 )
 
+// FailureStage describes which leg of a proxied connection an error
+// happened on: talking to the proxy itself, or talking to the origin site
+// through it. It's only set when a ProxyingInfo was attached via WithProxy
+// -- without that context a *net.OpError looks the same whether it failed
+// dialing the proxy or dialing the destination through an open tunnel.
+type FailureStage string
+
+const (
+	ProxyDial    FailureStage = "proxy-dial"
+	ProxyTLS     FailureStage = "proxy-tls"
+	ProxyConnect FailureStage = "proxy-connect"
+	ProxyAuth    FailureStage = "proxy-auth"
+	OriginDial   FailureStage = "origin-dial"
+	OriginTLS    FailureStage = "origin-tls"
+	OriginRead   FailureStage = "origin-read"
+)
+
 // ProxyingInfo encapsulates fields to describe an access through a proxy channel.
 type ProxyingInfo struct {
 	ProxyType  ProxyType `json:"proxyType,omitempty"`
@@ -100,10 +119,41 @@ type Error struct {
 	Op Op `json:"operation,omitempty"`
 	// Any extra fields
 	Extra map[string]string `json:"extra,omitempty"`
+	// FailureStage is set by classifyProxyError when a ProxyingInfo is
+	// present, so the reporter backend can separate upstream-proxy
+	// incidents from destination-site incidents.
+	FailureStage FailureStage `json:"failureStage,omitempty"`
+	// Causes holds the structured classification of each further link in
+	// err's chain below this one (innermost last), so wrapping a
+	// *net.OpError in a *url.Error no longer hides the OpError's op/addr
+	// details behind the url.Error's own classification.
+	Causes []*Error `json:"causes,omitempty"`
 	*systemInfo
 	*ProxyingInfo
 	*UserLocale
 	*UserAgentInfo
+
+	// cause is the next link below the error this Error was parsed from
+	// (errors.Unwrap of it), or the error attached via WithCause. Unwrap
+	// returns it, so errors.Is/errors.As see through an *Error to that link
+	// and everything below it.
+	cause error
+}
+
+// Error implements the error interface so *Error can be passed to
+// errors.Is/errors.As and generally used anywhere a plain error is
+// expected.
+func (e *Error) Error() string {
+	if e.Desc == "" {
+		return e.GoType
+	}
+	return fmt.Sprintf("%s: %s", e.GoType, e.Desc)
+}
+
+// Unwrap returns the next link below the error this Error was parsed from,
+// or the cause attached via WithCause, if any.
+func (e *Error) Unwrap() error {
+	return e.cause
 }
 
 // Customized marshaller to marshal extra fields to same level as other struct fields
@@ -159,6 +209,16 @@ func WithUserAgent(info *UserAgentInfo) withFunc {
 	}
 }
 
+// WithCause attaches err as this Error's cause. Use it when the error being
+// logged doesn't itself carry the lower-level cause in its chain (e.g. a
+// sentinel error plus a cause captured separately), so that cause still
+// shows up in Causes and is still reachable via Unwrap/errors.Is/errors.As.
+func WithCause(err error) withFunc {
+	return func(e *Error) {
+		e.cause = err
+	}
+}
+
 func (c *ErrorCollector) Log(err error, with ...withFunc) {
 	errOp, goType, desc, extra := parseError(err)
 	actual := &Error{
@@ -168,13 +228,148 @@ func (c *ErrorCollector) Log(err error, with ...withFunc) {
 		Op:         Op(errOp),
 		Extra:      extra,
 		systemInfo: c.systemInfo,
+		cause:      stderrors.Unwrap(err),
 	}
 	for _, f := range with {
 		f(actual)
 	}
+	if actual.ProxyingInfo != nil {
+		classifyProxyError(actual, err)
+	}
+	actual.Causes = collectCauses(actual.cause)
 	currentReporter.Report(actual)
 }
 
+// ProxyConnectError is returned by Lantern's CONNECT-tunnel dialer when the
+// proxy answers a CONNECT request with a non-200 status, so
+// classifyProxyError can tell a proxy-side rejection (e.g. auth required)
+// apart from a TCP or TLS failure reaching the proxy at all.
+type ProxyConnectError struct {
+	StatusCode        int
+	ProxyAuthenticate string
+}
+
+func (e *ProxyConnectError) Error() string {
+	return fmt.Sprintf("proxy CONNECT failed: %d", e.StatusCode)
+}
+
+// classifyProxyError walks err's chain looking for the proxy-tunnel failure
+// modes that e.ProxyingInfo gives us enough context to tell apart -- a
+// rejected CONNECT, a dial or TLS handshake that failed against the proxy
+// rather than the origin, a failed read (always counted as origin-read), or
+// malformed HTTP/1.x framing on the CONNECT response --
+// and sets e.FailureStage accordingly. It leaves FailureStage unset if err
+// doesn't match any of those shapes.
+func classifyProxyError(e *Error, err error) {
+	info := e.ProxyingInfo
+	for cur := err; cur != nil; cur = stderrors.Unwrap(cur) {
+		switch actual := cur.(type) {
+		case *ProxyConnectError:
+			if actual.StatusCode == http.StatusProxyAuthRequired {
+				e.FailureStage = ProxyAuth
+			} else {
+				e.FailureStage = ProxyConnect
+			}
+			if e.Extra == nil {
+				e.Extra = map[string]string{}
+			}
+			e.Extra["statusCode"] = strconv.Itoa(actual.StatusCode)
+			if actual.ProxyAuthenticate != "" {
+				e.Extra["proxyAuthenticate"] = actual.ProxyAuthenticate
+			}
+			return
+		case *net.OpError:
+			atProxy := info.ProxyAddr != "" && actual.Addr != nil && actual.Addr.String() == info.ProxyAddr
+			switch {
+			case isTLSError(actual.Err):
+				if atProxy {
+					e.FailureStage = ProxyTLS
+				} else {
+					e.FailureStage = OriginTLS
+				}
+			case actual.Op == "dial":
+				if atProxy {
+					e.FailureStage = ProxyDial
+				} else {
+					e.FailureStage = OriginDial
+				}
+			case actual.Op == "read":
+				e.FailureStage = OriginRead
+			}
+			return
+		case *textproto.Error, textproto.ProtocolError, *textproto.ProtocolError:
+			// Malformed response framing is only reachable while parsing
+			// the CONNECT response itself -- origin traffic is tunneled
+			// opaque bytes by that point.
+			e.FailureStage = ProxyConnect
+			return
+		}
+		if isTLSError(cur) {
+			if info.ProxyAddr != "" {
+				e.FailureStage = ProxyTLS
+			} else {
+				e.FailureStage = OriginTLS
+			}
+			return
+		}
+	}
+}
+
+// isTLSError reports whether err is one of the handshake/certificate error
+// types parseError already classifies as TLS-related.
+func isTLSError(err error) bool {
+	switch err.(type) {
+	case tls.RecordHeaderError, *tls.RecordHeaderError,
+		x509.CertificateInvalidError, x509.HostnameError, x509.UnknownAuthorityError:
+		return true
+	default:
+		return false
+	}
+}
+
+// collectCauses walks the rest of err's chain via errors.Unwrap -- the same
+// primitive errors.Is/errors.As are built on -- classifying each link the
+// same way Log classifies the top-level error. This is what lets, e.g., a
+// *url.Error wrapping a *net.OpError wrapping a syscall.Errno report all
+// three links instead of just the outermost url.Error.
+func collectCauses(err error) []*Error {
+	var causes []*Error
+	for err != nil {
+		op, goType, desc, extra := parseError(err)
+		causes = append(causes, &Error{
+			GoType: goType,
+			Desc:   desc,
+			Op:     Op(op),
+			Extra:  extra,
+		})
+		err = stderrors.Unwrap(err)
+	}
+	return causes
+}
+
+// Wrap attaches desc to err, returning a new error whose chain still leads
+// to err, so a later Log call (or any errors.Is/errors.As caller) can see
+// straight through the description to classify the original cause.
+func Wrap(err error, desc string) error {
+	if err == nil {
+		return nil
+	}
+	return &wrapError{desc: desc, err: err}
+}
+
+type wrapError struct {
+	desc string
+	err  error
+}
+
+func (w *wrapError) Error() string {
+	return w.desc + ": " + w.err.Error()
+}
+
+func (w *wrapError) Unwrap() error {
+	return w.err
+}
+
 func NewErrorCollector(goPackage string) *ErrorCollector {
 	version, _ := osversion.GetHumanReadable()
 	return &ErrorCollector{
@@ -188,14 +383,29 @@ func NewErrorCollector(goPackage string) *ErrorCollector {
 	}
 }
 
+// Reporter sends a classified Error wherever errors are collected. Report
+// may return an error, which AsyncReporter treats as grounds to retry;
+// simple synchronous reporters can always return nil. Close lets a Reporter
+// release resources (flush a network client, etc) when it's replaced via
+// ReportTo or the process is shutting down.
 type Reporter interface {
-	Report(*Error)
+	Report(*Error) error
+	Close(ctx context.Context) error
 }
 
 var currentReporter Reporter = &StdReporter{}
 
+// ReportTo replaces the current reporter with r, closing the previous one
+// in the background so any reports it still had buffered (e.g. an
+// AsyncReporter) get a chance to drain instead of being silently lost.
 func ReportTo(r Reporter) {
+	old := currentReporter
 	currentReporter = r
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = old.Close(ctx)
+	}()
 }
 
 func toJSON(e *Error) []byte {
@@ -209,8 +419,14 @@ func toJSON(e *Error) []byte {
 type StdReporter struct {
 }
 
-func (l StdReporter) Report(e *Error) {
+func (l StdReporter) Report(e *Error) error {
 	fmt.Printf("%+v", string(toJSON(e)))
+	return nil
+}
+
+// Close is a no-op: StdReporter holds no resources worth releasing.
+func (l StdReporter) Close(ctx context.Context) error {
+	return nil
 }
 
 func parseError(err error) (op string, goType string, desc string, extra map[string]string) {
@@ -48,9 +48,40 @@ var (
 	hash = getExecutableHash()
 )
 
-// Start starts the GA session with the given data.
+// Backend selects which analytics system Start reports to.
+type Backend string
+
+const (
+	// GABackend reports pageview-style sessions to Google Analytics, as
+	// Lantern always has.
+	GABackend Backend = "ga"
+	// OTLPBackend reports counters, histograms and spans to a
+	// Lantern-operated OpenTelemetry collector instead, without sending any
+	// of it to Google.
+	OTLPBackend Backend = "otlp"
+	// OffBackend disables analytics reporting entirely.
+	OffBackend Backend = "off"
+)
+
+// Start starts a GA session with the given data. Kept for callers that
+// haven't been updated to pick a backend explicitly; equivalent to
+// StartWithBackend(GABackend, deviceID, version).
 func Start(deviceID, version string) func() {
-	return start(deviceID, version, geolookup.GetIP, maxWaitForUserAgent, trackSession)
+	return StartWithBackend(GABackend, deviceID, version)
+}
+
+// StartWithBackend starts an analytics session using the given backend, as
+// configured by Settings.analyticsBackend. The returned func ends the
+// session and should be called on shutdown.
+func StartWithBackend(backend Backend, deviceID, version string) func() {
+	switch backend {
+	case OTLPBackend:
+		return startOTLP(deviceID, version)
+	case OffBackend:
+		return func() {}
+	default:
+		return start(deviceID, version, geolookup.GetIP, maxWaitForUserAgent, trackSession)
+	}
 }
 
 // start starts the GA session with the given data.
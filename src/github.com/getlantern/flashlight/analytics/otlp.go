@@ -0,0 +1,175 @@
+package analytics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errlog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultOTLPEndpoint is used if the cloud config hasn't supplied one yet at
+// the time Start is called.
+const defaultOTLPEndpoint = "otlp.getlantern.org:4317"
+
+// otlpState holds the live SDK handles for the OTLP backend. There's at most
+// one of these per process, mirroring how the GA backend has no per-instance
+// state beyond the package-level vars above.
+type otlpState struct {
+	mu              sync.Mutex
+	endpoint        string
+	samplingRatio   float64
+	meterProvider   *sdkmetric.MeterProvider
+	tracerProvider  *sdktrace.TracerProvider
+	sessionsStarted metric.Int64Counter
+	sessionsEnded   metric.Int64Counter
+	configFetchMS   metric.Float64Histogram
+	proxyDialMS     metric.Float64Histogram
+}
+
+var otlp = &otlpState{endpoint: defaultOTLPEndpoint, samplingRatio: 1.0}
+
+// SetOTLPConfig updates the collector endpoint and trace sampling ratio,
+// driven from cloud.yaml (see configEnvelope in the config package) rather
+// than hard-coded. The values are read only when ensureStarted builds the
+// exporters and providers, which happens once per process (and again only
+// after stopOTLP); a change made after that does not reach the running
+// providers.
+func SetOTLPConfig(endpoint string, samplingRatio float64) {
+	otlp.mu.Lock()
+	defer otlp.mu.Unlock()
+	if endpoint != "" {
+		otlp.endpoint = endpoint
+	}
+	if samplingRatio > 0 {
+		otlp.samplingRatio = samplingRatio
+	}
+}
+
+// startOTLP starts an OTLP session in place of the GA session: a span
+// covering the session's lifetime, plus counters/histograms that give us
+// per-proxy health telemetry without sending anything to Google. The
+// returned stopper ends the span and flushes pending telemetry.
+func startOTLP(deviceID, version string) func() {
+	otlp.mu.Lock()
+	endpoint, ratio := otlp.endpoint, otlp.samplingRatio
+	otlp.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := otlp.ensureStarted(ctx, endpoint, ratio); err != nil {
+		elog.Log(err, errlog.WithOp("start-otlp"))
+		return func() {}
+	}
+
+	attrs := metric.WithAttributes(
+		attribute.String("deviceID", deviceID),
+		attribute.String("version", version),
+		attribute.String("executableHash", hash),
+	)
+	otlp.sessionsStarted.Add(context.Background(), 1, attrs)
+
+	tracer := otlp.tracerProvider.Tracer("github.com/getlantern/flashlight/analytics")
+	_, span := tracer.Start(context.Background(), "session",
+		trace.WithAttributes(
+			attribute.String("deviceID", deviceID),
+			attribute.String("version", version),
+		))
+
+	return func() {
+		otlp.sessionsEnded.Add(context.Background(), 1, attrs)
+		span.End()
+	}
+}
+
+// ensureStarted lazily builds the meter and tracer providers on first use,
+// so that simply selecting the otlp backend without ever calling Start costs
+// nothing.
+func (s *otlpState) ensureStarted(ctx context.Context, endpoint string, samplingRatio float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.meterProvider != nil {
+		return nil
+	}
+
+	metricExporter, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpoint(endpoint), otlpmetricgrpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+
+	s.meterProvider = sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)),
+	)
+	s.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithSampler(sdktrace.TraceIDRatioBased(samplingRatio)),
+	)
+
+	meter := s.meterProvider.Meter("github.com/getlantern/flashlight/analytics")
+	if s.sessionsStarted, err = meter.Int64Counter("lantern.sessions.started"); err != nil {
+		return err
+	}
+	if s.sessionsEnded, err = meter.Int64Counter("lantern.sessions.ended"); err != nil {
+		return err
+	}
+	if s.configFetchMS, err = meter.Float64Histogram("lantern.config_fetch.duration_ms"); err != nil {
+		return err
+	}
+	if s.proxyDialMS, err = meter.Float64Histogram("lantern.proxy_dial.duration_ms"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RecordConfigFetchLatency reports how long a fetchCloudConfig call took. A
+// no-op if the OTLP backend hasn't been started (GA and off backends don't
+// pay for this).
+func RecordConfigFetchLatency(d time.Duration) {
+	otlp.mu.Lock()
+	hist := otlp.configFetchMS
+	otlp.mu.Unlock()
+	if hist != nil {
+		hist.Record(context.Background(), float64(d/time.Millisecond))
+	}
+}
+
+// RecordProxyDialLatency reports how long it took to dial a proxy. A no-op
+// if the OTLP backend hasn't been started.
+func RecordProxyDialLatency(proxyType string, d time.Duration) {
+	otlp.mu.Lock()
+	hist := otlp.proxyDialMS
+	otlp.mu.Unlock()
+	if hist != nil {
+		hist.Record(context.Background(), float64(d/time.Millisecond), metric.WithAttributes(attribute.String("proxyType", proxyType)))
+	}
+}
+
+// stopOTLP flushes and shuts down the providers. Exposed mainly for tests
+// and clean process exit; the per-session stopper returned by startOTLP
+// does not call this, since the providers are shared across sessions.
+func stopOTLP() {
+	otlp.mu.Lock()
+	defer otlp.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if s := otlp.tracerProvider; s != nil {
+		_ = s.Shutdown(ctx)
+	}
+	if s := otlp.meterProvider; s != nil {
+		_ = s.Shutdown(ctx)
+	}
+	otlp.meterProvider = nil
+	otlp.tracerProvider = nil
+}
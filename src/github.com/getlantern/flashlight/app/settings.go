@@ -5,17 +5,25 @@ import (
 	"net/http"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/getlantern/appdir"
 	"github.com/getlantern/errors"
 	"github.com/getlantern/launcher"
 	"github.com/getlantern/yaml"
 
+	"github.com/getlantern/flashlight/analytics"
 	"github.com/getlantern/flashlight/ui"
 )
 
 const (
 	messageType = `settings`
+
+	// saveDebounce is how long save waits after the last change before
+	// actually writing settings.yaml, so that a burst of setter calls (e.g.
+	// several UI toggles in a row) produces one write instead of one per
+	// call.
+	saveDebounce = 250 * time.Millisecond
 )
 
 var (
@@ -37,13 +45,77 @@ type Settings struct {
 	ProxyAll    bool `json:"proxyAll"`
 	SystemProxy bool `json:"systemProxy"`
 
+	// AnalyticsBackend selects which system session and per-proxy health
+	// telemetry is reported to. See analytics.Backend.
+	AnalyticsBackend analytics.Backend `json:"analyticsBackend,omitempty"`
+
 	Version      string `json:"version" yaml:"-"`
 	BuildDate    string `json:"buildDate" yaml:"-"`
 	RevisionDate string `json:"revisionDate" yaml:"-"`
 
+	// SchemaVersion records which numbered migration this file was last
+	// brought up to date by. See settings_schema.go.
+	SchemaVersion int `json:"-" yaml:"schemaVersion"`
+
+	notifier *changeNotifier `json:"-" yaml:"-"`
+
+	// analyticsStop ends the currently running analytics session, if any, so
+	// applyAnalyticsBackend can stop it before starting a new one when
+	// AnalyticsBackend changes.
+	analyticsStop func() `json:"-" yaml:"-"`
+
+	// path is the settings.yaml these settings were loaded from, and where
+	// save writes them back.
+	path string `json:"-" yaml:"-"`
+
+	// saveMu and saveTimer implement the debounce in scheduleSave. They're
+	// deliberately not covered by the embedded RWMutex below, since arming a
+	// timer isn't a read or write of the settings fields themselves.
+	saveMu    sync.Mutex  `json:"-" yaml:"-"`
+	saveTimer *time.Timer `json:"-" yaml:"-"`
+
 	sync.RWMutex `json:"-" yaml:"-"`
 }
 
+// SettingsSnapshot is an immutable, lock-free copy of Settings' data fields,
+// for readers like the analytics and config packages that only need a
+// consistent point-in-time view instead of taking RLock on every read.
+type SettingsSnapshot struct {
+	DeviceID  string
+	UserID    string
+	UserToken string
+
+	AutoReport  bool
+	AutoLaunch  bool
+	ProxyAll    bool
+	SystemProxy bool
+
+	AnalyticsBackend analytics.Backend
+
+	Version      string
+	BuildDate    string
+	RevisionDate string
+}
+
+// Snapshot returns an immutable copy of the current settings.
+func (s *Settings) Snapshot() SettingsSnapshot {
+	s.RLock()
+	defer s.RUnlock()
+	return SettingsSnapshot{
+		DeviceID:         s.DeviceID,
+		UserID:           s.UserID,
+		UserToken:        s.UserToken,
+		AutoReport:       s.AutoReport,
+		AutoLaunch:       s.AutoLaunch,
+		ProxyAll:         s.ProxyAll,
+		SystemProxy:      s.SystemProxy,
+		AnalyticsBackend: s.AnalyticsBackend,
+		Version:          s.Version,
+		BuildDate:        s.BuildDate,
+		RevisionDate:     s.RevisionDate,
+	}
+}
+
 func loadSettings(version, revisionDate, buildDate string) *Settings {
 	return loadSettingsFrom(version, revisionDate, buildDate, path)
 }
@@ -55,16 +127,20 @@ func loadSettingsFrom(version, revisionDate, buildDate, path string) *Settings {
 	// Create default settings that may or may not be overridden from an existing file
 	// on disk.
 	settings = &Settings{
-		AutoReport:  true,
-		AutoLaunch:  true,
-		ProxyAll:    false,
-		SystemProxy: true,
+		AutoReport:       true,
+		AutoLaunch:       true,
+		ProxyAll:         false,
+		SystemProxy:      true,
+		AnalyticsBackend: analytics.GABackend,
+		SchemaVersion:    currentSchemaVersion,
+		notifier:         newChangeNotifier(),
+		path:             path,
 	}
 
 	// Use settings from disk if they're available.
 	if bytes, err := ioutil.ReadFile(path); err != nil {
 		log.Debugf("Could not read file %v", err)
-	} else if err := yaml.Unmarshal(bytes, settings); err != nil {
+	} else if err := decodeSettings(bytes, settings); err != nil {
 		errors.Wrap(err).WithOp("load-settings").Report()
 		// Just keep going with the original settings not from disk.
 	} else {
@@ -93,11 +169,23 @@ func loadSettingsFrom(version, revisionDate, buildDate, path string) *Settings {
 	return settings
 }
 
+// resetForTest discards the package-level state loadSettingsFrom sets up --
+// settings, service and the start-once guard -- so a test can call
+// loadSettingsFrom again and get a fresh call to start() instead of being
+// stuck with whatever the first call registered. Not used outside tests.
+func resetForTest() {
+	once = &sync.Once{}
+	settings = nil
+	service = nil
+}
+
 // start the settings service that synchronizes Lantern's configuration with every UI client
 func (s *Settings) start() error {
 	var err error
 
 	ui.PreferProxiedUI(s.SystemProxy)
+	s.subscribeToOwnChanges()
+	s.applyAnalyticsBackend(s.AnalyticsBackend)
 	helloFn := func(write func(interface{}) error) error {
 		log.Debugf("Sending Lantern settings to new client")
 		s.Lock()
@@ -122,45 +210,52 @@ func (s *Settings) read(in <-chan interface{}, out chan<- interface{}) {
 			continue
 		}
 
+		// validateMessage rejects unknown fields and type mismatches up front,
+		// loudly, instead of each setter below silently no-op'ing on a typo.
+		data = validateMessage(data)
+
 		s.checkBool(data, "autoReport", s.SetAutoReport)
 		s.checkBool(data, "proxyAll", s.SetProxyAll)
 		s.checkBool(data, "autoLaunch", s.SetAutoLaunch)
 		s.checkBool(data, "systemProxy", s.SetSystemProxy)
 		s.checkString(data, "userID", s.SetUserID)
 		s.checkString(data, "token", s.SetToken)
+		s.checkString(data, "analyticsBackend", func(v string) { s.SetAnalyticsBackend(analytics.Backend(v)) })
 
 		out <- s
 	}
 }
 
 func (s *Settings) checkBool(data map[string]interface{}, name string, f func(bool)) {
-	if v, ok := data[name].(bool); ok {
-		f(v)
-	} else {
-		errors.New("can not convert to bool").With("name", name).With("value", data[name]).Report()
+	if v, ok := data[name]; ok {
+		f(v.(bool))
 	}
 }
 
 func (s *Settings) checkString(data map[string]interface{}, name string, f func(string)) {
-	if v, ok := data[name].(string); ok {
-		f(v)
-	} else {
-		errors.New("can not convert to string").With("name", name).With("value", data[name]).Report()
+	if v, ok := data[name]; ok {
+		f(v.(string))
 	}
 }
 
-// Save saves settings to disk.
+// save writes settings to disk, atomically: it marshals under RLock (so it
+// never blocks a concurrent setter for longer than the marshal itself), then
+// writes via writeFileAtomic so a crash mid-write can never leave a
+// truncated settings.yaml on disk.
 func (s *Settings) save() {
 	log.Debug("Saving settings")
-	s.Lock()
-	defer s.Unlock()
-	if bytes, err := yaml.Marshal(s); err != nil {
+	s.RLock()
+	bytes, err := yaml.Marshal(s)
+	s.RUnlock()
+	if err != nil {
 		errors.Wrap(err).Report()
-	} else if err := ioutil.WriteFile(path, bytes, 0644); err != nil {
+		return
+	}
+	if err := writeFileAtomic(s.path, bytes, 0644); err != nil {
 		errors.Wrap(err).With("file", filepath.Base(path)).Report()
-	} else {
-		log.Debugf("Saved settings to %s with contents %v", path, string(bytes))
+		return
 	}
+	log.Debugf("Saved settings to %s with contents %v", s.path, string(bytes))
 }
 
 // GetProxyAll returns whether or not to proxy all traffic.
@@ -173,10 +268,10 @@ func (s *Settings) GetProxyAll() bool {
 // SetProxyAll sets whether or not to proxy all traffic.
 func (s *Settings) SetProxyAll(proxyAll bool) {
 	s.Lock()
-	defer s.unlockAndSave()
+	old := s.ProxyAll
 	s.ProxyAll = proxyAll
-	// Cycle the PAC file so that browser picks up changes
-	cyclePAC()
+	s.unlockAndSave()
+	s.notifier.notify("proxyAll", old, proxyAll)
 }
 
 // IsAutoReport returns whether or not to auto-report debugging and analytics data.
@@ -243,13 +338,47 @@ func (s *Settings) GetUserID() string {
 	return s.UserID
 }
 
+// GetAnalyticsBackend returns which analytics backend session and per-proxy
+// health telemetry is currently reported to.
+func (s *Settings) GetAnalyticsBackend() analytics.Backend {
+	s.RLock()
+	defer s.RUnlock()
+	return s.AnalyticsBackend
+}
+
+// SetAnalyticsBackend selects which analytics backend session and
+// per-proxy health telemetry should be reported to.
+func (s *Settings) SetAnalyticsBackend(backend analytics.Backend) {
+	s.Lock()
+	old := s.AnalyticsBackend
+	s.AnalyticsBackend = backend
+	s.unlockAndSave()
+	if backend != old {
+		s.notifier.notify("analyticsBackend", old, backend)
+	}
+}
+
 // SetSystemProxy sets whether or not to set system proxy when lantern starts
 func (s *Settings) SetSystemProxy(enable bool) {
 	s.Lock()
-	defer s.unlockAndSave()
-	changed := enable != s.SystemProxy
+	old := s.SystemProxy
 	s.SystemProxy = enable
-	if changed {
+	s.unlockAndSave()
+	if enable != old {
+		s.notifier.notify("systemProxy", old, enable)
+	}
+}
+
+// subscribeToOwnChanges wires up the side effects that used to live inline
+// in the setters above (cyclePAC, pacOn/pacOff, ui.PreferProxiedUI) as
+// Subscribe callbacks instead, so SetProxyAll/SetSystemProxy only need to
+// know about changing and persisting their own field.
+func (s *Settings) subscribeToOwnChanges() {
+	Subscribe(s, "proxyAll", func(old, new bool) {
+		// Cycle the PAC file so that browser picks up changes
+		cyclePAC()
+	})
+	Subscribe(s, "systemProxy", func(old, enable bool) {
 		if enable {
 			pacOn()
 		} else {
@@ -260,12 +389,46 @@ func (s *Settings) SetSystemProxy(enable bool) {
 			log.Debugf("System proxying disabled, redirect UI to: %v", preferredUIAddr)
 			service.Out <- map[string]string{"redirectTo": preferredUIAddr}
 		}
+	})
+	Subscribe(s, "analyticsBackend", func(old, backend analytics.Backend) {
+		s.applyAnalyticsBackend(backend)
+	})
+}
+
+// applyAnalyticsBackend stops whatever analytics session is currently
+// running, if any, and starts a new one against backend. Called once at
+// startup with the value loaded from disk and again by subscribeToOwnChanges
+// whenever analyticsBackend changes.
+func (s *Settings) applyAnalyticsBackend(backend analytics.Backend) {
+	s.Lock()
+	stop := s.analyticsStop
+	deviceID, version := s.DeviceID, s.Version
+	s.Unlock()
+	if stop != nil {
+		stop()
 	}
+	newStop := analytics.StartWithBackend(backend, deviceID, version)
+	s.Lock()
+	s.analyticsStop = newStop
+	s.Unlock()
 }
 
-// unlockAndSave releases the lock on writing to settings and then saves settings.
+// unlockAndSave releases the lock on writing to settings and then schedules
+// a debounced save.
 func (s *Settings) unlockAndSave() {
 	// Note locks in go aren't reentrant, so we need to unlock before save locks again.
 	s.Unlock()
-	s.save()
+	s.scheduleSave()
+}
+
+// scheduleSave coalesces rapid successive setter calls into a single write
+// saveDebounce after the last one, instead of rewriting settings.yaml on
+// every call.
+func (s *Settings) scheduleSave() {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if s.saveTimer != nil {
+		s.saveTimer.Stop()
+	}
+	s.saveTimer = time.AfterFunc(saveDebounce, s.save)
 }
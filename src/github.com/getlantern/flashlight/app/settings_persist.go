@@ -0,0 +1,27 @@
+package app
+
+import "os"
+
+// writeFileAtomic writes data to a temp file next to path, fsyncs it, and
+// renames it over path. A crash or power loss mid-write can therefore never
+// leave path holding a truncated settings.yaml -- readers either see the
+// old file or the fully-written new one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
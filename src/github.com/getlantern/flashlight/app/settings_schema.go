@@ -0,0 +1,116 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/yaml"
+)
+
+// currentSchemaVersion is the on-disk settings.yaml format version this
+// build writes. Bump it and add a migration function to schemaMigrations
+// whenever a field is renamed or removed, so upgrading clients don't
+// silently lose user data.
+const currentSchemaVersion = 1
+
+// schemaMigrations holds one function per version transition, indexed by
+// the version being migrated *from*. migrateFromV0 runs for a file with no
+// schemaVersion field (or schemaVersion: 0) and brings it up to v1, etc.
+// Run them in order starting from the file's recorded version.
+var schemaMigrations = []func(map[string]interface{}){
+	migrateFromV0,
+}
+
+// migrateFromV0 is a no-op today; it exists as the template for the first
+// real rename/removal, e.g.:
+//
+//	if v, ok := data["oldFieldName"]; ok {
+//		data["newFieldName"] = v
+//		delete(data, "oldFieldName")
+//	}
+func migrateFromV0(data map[string]interface{}) {
+}
+
+// migrate applies every migration from the file's recorded version up to
+// currentSchemaVersion, in place, and returns the resulting version.
+func migrate(data map[string]interface{}) int {
+	version := 0
+	if v, ok := data["schemaVersion"].(int); ok {
+		version = v
+	}
+	for version < currentSchemaVersion && version < len(schemaMigrations) {
+		schemaMigrations[version](data)
+		version++
+	}
+	data["schemaVersion"] = currentSchemaVersion
+	return currentSchemaVersion
+}
+
+// settingsFieldKind is the type a field the UI is allowed to set must decode
+// as, so that read can validate incoming messages instead of silently
+// ignoring a mistyped or misspelled key.
+type settingsFieldKind int
+
+const (
+	boolField settingsFieldKind = iota
+	stringField
+)
+
+// settingsFields whitelists the fields the UI may write via a settings
+// message, and the type each must decode as. A key here that the UI sends
+// with the wrong type, or a key the UI sends that isn't here at all, is
+// reported rather than silently dropped.
+var settingsFields = map[string]settingsFieldKind{
+	"autoReport":       boolField,
+	"proxyAll":         boolField,
+	"autoLaunch":       boolField,
+	"systemProxy":      boolField,
+	"userID":           stringField,
+	"token":            stringField,
+	"analyticsBackend": stringField,
+}
+
+// validateMessage checks data against settingsFields, reporting (but not
+// otherwise acting on) any unknown field or type mismatch. It returns only
+// the entries that passed validation, so callers can still process the
+// rest of a message that has one bad field.
+func validateMessage(data map[string]interface{}) map[string]interface{} {
+	valid := make(map[string]interface{}, len(data))
+	for name, value := range data {
+		kind, known := settingsFields[name]
+		if !known {
+			errors.New("unknown settings field").With("name", name).Report()
+			continue
+		}
+		switch kind {
+		case boolField:
+			if _, ok := value.(bool); !ok {
+				errors.New("settings field has wrong type").With("name", name).With("expected", "bool").Report()
+				continue
+			}
+		case stringField:
+			if _, ok := value.(string); !ok {
+				errors.New("settings field has wrong type").With("name", name).With("expected", "string").Report()
+				continue
+			}
+		}
+		valid[name] = value
+	}
+	return valid
+}
+
+// decodeSettings runs the versioned-migration pass over raw settings.yaml
+// bytes and unmarshals the result into settings, which should already hold
+// the desired defaults for any field absent from disk.
+func decodeSettings(bytes []byte, settings *Settings) error {
+	data := map[string]interface{}{}
+	if err := yaml.Unmarshal(bytes, &data); err != nil {
+		return fmt.Errorf("unable to parse settings.yaml: %v", err)
+	}
+	migrate(data)
+	migrated, err := yaml.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("unable to re-marshal migrated settings: %v", err)
+	}
+	return yaml.Unmarshal(migrated, settings)
+}
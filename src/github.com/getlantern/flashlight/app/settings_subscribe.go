@@ -0,0 +1,43 @@
+package app
+
+import "sync"
+
+// changeNotifier dispatches a settings field's old/new value to subscribers
+// after it's been changed, replacing the old pattern of calling cyclePAC,
+// pacOn/pacOff and ui.PreferProxiedUI directly inline in each setter.
+type changeNotifier struct {
+	mu          sync.Mutex
+	subscribers map[string][]func(old, new interface{})
+}
+
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{subscribers: map[string][]func(old, new interface{}){}}
+}
+
+func (n *changeNotifier) subscribe(field string, fn func(old, new interface{})) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.subscribers[field] = append(n.subscribers[field], fn)
+}
+
+func (n *changeNotifier) notify(field string, old, new interface{}) {
+	n.mu.Lock()
+	fns := append([]func(old, new interface{}){}, n.subscribers[field]...)
+	n.mu.Unlock()
+	for _, fn := range fns {
+		fn(old, new)
+	}
+}
+
+// Subscribe registers fn to be called with a field's old and new value
+// every time it changes via one of Settings' setters. field names match
+// the settings.yaml/JSON keys, e.g. "proxyAll" or "systemProxy".
+//
+// Subscribe is a free function rather than a method because Go methods
+// can't be generic; callers write Subscribe(s, "proxyAll", func(old, new
+// bool) {...}) instead of s.Subscribe(...).
+func Subscribe[T any](s *Settings, field string, fn func(old, new T)) {
+	s.notifier.subscribe(field, func(old, new interface{}) {
+		fn(old.(T), new.(T))
+	})
+}
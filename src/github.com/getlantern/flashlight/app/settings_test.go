@@ -0,0 +1,104 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/analytics"
+)
+
+func withTempSettingsPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "lantern-settings-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return filepath.Join(dir, "settings.yaml")
+}
+
+func TestLoadSettingsFromDefaults(t *testing.T) {
+	defer resetForTest()
+	path := withTempSettingsPath(t)
+
+	s := loadSettingsFrom("1.0.0", "2020-01-01", "2020-01-02", path)
+
+	if !s.AutoReport || !s.AutoLaunch || !s.SystemProxy || s.ProxyAll {
+		t.Fatalf("unexpected defaults for a settings.yaml-less startup: %+v", s)
+	}
+	if s.AnalyticsBackend != analytics.GABackend {
+		t.Fatalf("expected default analytics backend %v, got %v", analytics.GABackend, s.AnalyticsBackend)
+	}
+	if s.Version != "1.0.0" || s.RevisionDate != "2020-01-01" || s.BuildDate != "2020-01-02" {
+		t.Fatalf("version metadata wasn't applied: %+v", s)
+	}
+}
+
+func TestLoadSettingsFromRoundTripsThroughDebouncedSave(t *testing.T) {
+	defer resetForTest()
+	path := withTempSettingsPath(t)
+
+	s := loadSettingsFrom("1.0.0", "", "", path)
+	s.SetUserID("user-1")
+	s.SetProxyAll(true)
+
+	// SetUserID/SetProxyAll only schedule a write via scheduleSave; give the
+	// debounce time to fire before asserting on disk contents.
+	waitForFile(t, path, saveDebounce*4)
+
+	resetForTest()
+	reloaded := loadSettingsFrom("1.0.0", "", "", path)
+	if reloaded.UserID != "user-1" {
+		t.Fatalf("expected userID to round-trip through a debounced save/reload, got %q", reloaded.UserID)
+	}
+	if !reloaded.ProxyAll {
+		t.Fatalf("expected proxyAll to round-trip through a debounced save/reload")
+	}
+}
+
+func TestResetForTestAllowsAFreshLoad(t *testing.T) {
+	defer resetForTest()
+	path := withTempSettingsPath(t)
+
+	// loadSettingsFrom always returns a fresh *Settings, reset or not, so
+	// pointer identity can't tell us whether once actually re-fired. start()
+	// (and so applyAnalyticsBackend, which sets analyticsStop) only runs
+	// inside once.Do, so analyticsStop is the observable signal: it should be
+	// set after the first load, left unset on a second load that doesn't go
+	// through resetForTest, and set again once resetForTest re-arms once.
+	first := loadSettingsFrom("1.0.0", "", "", path)
+	if first.analyticsStop == nil {
+		t.Fatalf("expected the first load to run start() and set analyticsStop")
+	}
+
+	withoutReset := loadSettingsFrom("1.0.0", "", "", path)
+	if withoutReset.analyticsStop != nil {
+		t.Fatalf("expected a second load without resetForTest to skip start(), since once already fired")
+	}
+
+	resetForTest()
+	afterReset := loadSettingsFrom("1.0.0", "", "", path)
+	if afterReset.analyticsStop == nil {
+		t.Fatalf("expected resetForTest to re-arm once so start() runs again")
+	}
+}
+
+// waitForFile polls until path exists and is non-empty, or fails the test
+// once timeout elapses.
+func waitForFile(t *testing.T, path string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v to be written", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
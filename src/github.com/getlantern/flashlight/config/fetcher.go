@@ -1,7 +1,9 @@
 package config
 
 import (
+	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -10,10 +12,9 @@ import (
 	"time"
 
 	"github.com/getlantern/errlog"
+	"github.com/getlantern/flashlight/analytics"
 	"github.com/getlantern/flashlight/util"
 	"github.com/getlantern/yamlconf"
-
-	"code.google.com/p/go-uuid/uuid"
 )
 
 const (
@@ -27,6 +28,10 @@ const (
 	// and because we only support falling back to direct domain fronting through
 	// the local proxy for HTTP.
 	frontedCloudConfigURL = "http://d2wi0vwulmtn99.cloudfront.net/cloud.yaml.gz"
+
+	// signatureSuffix is appended to a cloud config URL to find its detached
+	// signature.
+	signatureSuffix = ".sig"
 )
 
 var (
@@ -38,20 +43,64 @@ var (
 // fetcher periodically fetches the latest cloud configuration.
 type fetcher struct {
 	lastCloudConfigETag map[string]string
+	lastAppliedVersion  int64
 	user                UserConfig
 	httpFetcher         util.HTTPFetcher
+	extraSources        []ConfigSource
+	ranking             *sourceRanking
+	streamingSupported  bool
+	stream              *configStream
+
+	// needsRollback is set at construction if the previous run applied a
+	// config it never confirmed healthy, and consumed by the first
+	// pollForConfig call, which is the first point this package actually
+	// has a *Config to roll back.
+	needsRollback bool
 }
 
 // UserConfig retrieves any custom user info for fetching the config.
 type UserConfig interface {
 	GetUserID() string
 	GetToken() string
+	// GetDeviceID returns a stable per-installation identifier used to
+	// decide whether a staged config rollout applies to this device.
+	GetDeviceID() string
 }
 
 // NewFetcher creates a new configuration fetcher with the specified
-// interface for obtaining the user ID and token if those are populated.
+// interface for obtaining the user ID and token if those are populated. If
+// the previous run applied a config that was never confirmed healthy (see
+// ConfirmHealthy), it's rolled back to the last-known-good config on the
+// first call to pollForConfig, once there's an actual *Config to roll back.
 func NewFetcher(conf UserConfig, httpFetcher util.HTTPFetcher) Fetcher {
-	return &fetcher{lastCloudConfigETag: map[string]string{}, user: conf, httpFetcher: httpFetcher}
+	return &fetcher{
+		lastCloudConfigETag: map[string]string{},
+		user:                conf,
+		httpFetcher:         httpFetcher,
+		ranking:             newSourceRanking(),
+		needsRollback:       pendingRollbackNeeded(),
+	}
+}
+
+// AddConfigSource registers an additional rendezvous channel (e.g. a DoH TXT
+// lookup or an IPFS gateway) that fetchCloudConfig will race alongside the
+// chained-proxy and domain-fronted sources built from the current Config.
+// This lets operators add new channels without a Lantern code change, as
+// long as whatever assembles the fetcher's Config also knows to call this.
+func (cf *fetcher) AddConfigSource(source ConfigSource) {
+	cf.extraSources = append(cf.extraSources, source)
+}
+
+// ConfirmHealthy should be called once the client has confirmed that it can
+// actually proxy traffic using the currently applied config. This promotes
+// that config to last-known-good. Nothing promotes it automatically: until
+// ConfirmHealthy is called, the currently applied config is considered at
+// risk and pollForConfig will roll back to the last-known-good config on the
+// next startup, even if this process runs for a long time and exits cleanly
+// -- only confirmed connectivity, not mere survival, proves the config
+// works.
+func ConfirmHealthy() {
+	promotePendingToLastGood()
 }
 
 func (cf *fetcher) pollForConfig(currentCfg yamlconf.Config, stickyConfig bool) (mutate func(yamlconf.Config) error, waitTime time.Duration, err error) {
@@ -63,6 +112,14 @@ func (cf *fetcher) pollForConfig(currentCfg yamlconf.Config, stickyConfig bool)
 	}
 	cfg := currentCfg.(*Config)
 	waitTime = cf.cloudPollSleepTime()
+
+	if cf.needsRollback {
+		cf.needsRollback = false
+		if rollbackMutate, ok := cf.rollbackToLastGood(); ok {
+			return rollbackMutate, waitTime, nil
+		}
+	}
+
 	if cfg.CloudConfig == "" {
 		log.Debugf("No cloud config URL!")
 		// Config doesn't have a CloudConfig, just ignore
@@ -73,57 +130,239 @@ func (cf *fetcher) pollForConfig(currentCfg yamlconf.Config, stickyConfig bool)
 		return mutate, waitTime, nil
 	}
 
-	if bytes, err := cf.fetchCloudConfig(cfg); err != nil {
+	if cf.streamingSupported {
+		return cf.pollViaStream(cfg)
+	}
+
+	fetchStart := time.Now()
+	bytes, err := cf.fetchCloudConfig(cfg)
+	analytics.RecordConfigFetchLatency(time.Since(fetchStart))
+	if err != nil {
 		elog.Log(err, errlog.WithOp("fetch-cloud-config"))
 		return mutate, waitTime, err
 	} else if bytes != nil {
 		// bytes will be nil if the config is unchanged (not modified)
-		mutate = func(ycfg yamlconf.Config) error {
-			log.Debugf("Merging cloud configuration")
-			cfg := ycfg.(*Config)
-
-			err := cfg.updateFrom(bytes)
-			if cfg.Client.ChainedServers != nil {
-				log.Debugf("Adding %d chained servers", len(cfg.Client.ChainedServers))
-				for _, s := range cfg.Client.ChainedServers {
-					log.Debugf("Got chained server: %v", s.Addr)
-				}
-			}
-			return err
-		}
+		mutate = cf.applyConfig(bytes)
 	} else {
 		log.Debugf("Bytes are nil - config not modified.")
 	}
 	return mutate, waitTime, nil
 }
 
+// applyConfig builds the mutate function that merges the given raw config
+// into the running Config. It recovers from panics in cfg.updateFrom and
+// treats those, like any other failure to apply, as a reason to fall back to
+// the last-known-good config instead of leaving the client on a half-applied
+// or crashing config.
+func (cf *fetcher) applyConfig(decompressed []byte) func(yamlconf.Config) error {
+	return func(ycfg yamlconf.Config) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic applying cloud config: %v", r)
+			}
+			if err != nil {
+				err = cf.rollbackTo(ycfg, err)
+			}
+		}()
+
+		log.Debugf("Merging cloud configuration")
+		cfg := ycfg.(*Config)
+		if applyErr := cfg.updateFrom(decompressed); applyErr != nil {
+			return applyErr
+		}
+		if cfg.Client.ChainedServers != nil {
+			log.Debugf("Adding %d chained servers", len(cfg.Client.ChainedServers))
+			for _, s := range cfg.Client.ChainedServers {
+				log.Debugf("Got chained server: %v", s.Addr)
+			}
+		}
+		markPending(decompressed)
+		return nil
+	}
+}
+
+// rollbackToLastGood builds a mutate function that re-applies the cached
+// last-known-good config, for use at startup when the previous run applied a
+// config it never confirmed healthy (see ConfirmHealthy). It also clears the
+// stale pending marker so a fresh fetch isn't blocked by it. ok is false if
+// there's no cached config to roll back to, in which case the caller should
+// fall through to a normal fetch.
+func (cf *fetcher) rollbackToLastGood() (mutate func(yamlconf.Config) error, ok bool) {
+	good, err := loadLastGoodConfig()
+	clearPendingMarker()
+	if err != nil || good == nil {
+		log.Debugf("Previous run never confirmed its applied config was healthy, but there's no last-known-good config to roll back to: %v", err)
+		return nil, false
+	}
+	log.Debugf("Previous run never confirmed its applied config was healthy; rolling back to last-known-good")
+	return func(ycfg yamlconf.Config) error {
+		return ycfg.(*Config).updateFrom(good)
+	}, true
+}
+
+// rollbackTo re-applies the last-known-good config in place of a config that
+// just failed to apply, logging but swallowing any error from doing so (the
+// original applyErr is what gets surfaced to the caller).
+func (cf *fetcher) rollbackTo(ycfg yamlconf.Config, applyErr error) error {
+	good, loadErr := loadLastGoodConfig()
+	if loadErr != nil || good == nil {
+		log.Debugf("No last-known-good config to roll back to: %v", loadErr)
+		return applyErr
+	}
+	cfg := ycfg.(*Config)
+	if err := cfg.updateFrom(good); err != nil {
+		log.Debugf("Rollback to last-known-good config also failed: %v", err)
+	} else {
+		log.Debugf("Rolled back to last-known-good config after error: %v", applyErr)
+	}
+	return applyErr
+}
+
+// fetchCloudConfig races every configured ConfigSource - the chained-proxy
+// and domain-fronted CDN built from cfg, plus anything registered via
+// AddConfigSource (DoH TXT lookups, IPFS/CID gateways, ...) and a
+// local-disk cache as the last resort - and returns the decompressed bytes
+// of whichever source wins, once its signature, version and rollout bucket
+// have all checked out.
 func (cf *fetcher) fetchCloudConfig(cfg *Config) ([]byte, error) {
 	log.Debugf("Fetching cloud config from %v (%v)", cfg.CloudConfig, cfg.FrontedCloudConfig)
 
-	url := cfg.CloudConfig
-	cb := "?" + uuid.New()
-	nocache := url + cb
-	req, err := http.NewRequest("GET", nocache, nil)
+	etagValue := cf.lastCloudConfigETag[cfg.CloudConfig]
+	sources := cf.buildSources(cfg)
+	result, err := raceSources(sources, cf.ranking, etagValue, cf.verifyResult)
+	if err != nil {
+		return nil, err
+	}
+	if result.notModified {
+		log.Debugf("Config unchanged in cloud")
+		return nil, nil
+	}
+
+	// The signature was already checked by verifyResult as a condition of
+	// winning the race, so acceptGzipped just needs to decompress and gate
+	// on version/rollout bucket here.
+	decompressed, err := cf.acceptGzipped(result.gzipped, result.signature, true)
+	if err != nil {
+		return nil, err
+	}
+	if decompressed == nil {
+		return nil, nil
+	}
+	if result.newETag != "" {
+		cf.lastCloudConfigETag[cfg.CloudConfig] = result.newETag
+	}
+	log.Debugf("Fetched cloud config from %v", result.source)
+	return decompressed, nil
+}
+
+// acceptGzipped verifies gzipped's detached signature (unless
+// skipSigVerify, e.g. for data we've already verified once and cached to
+// disk), decompresses it, and checks its version and rollout bucket. It
+// returns a nil slice with no error when the config should be silently
+// ignored (stale version or not in this device's rollout bucket yet), and is
+// shared by the regular poll and the long-poll/SSE stream so both apply the
+// same gating rules.
+func (cf *fetcher) acceptGzipped(gzipped, signature []byte, skipSigVerify bool) ([]byte, error) {
+	if !skipSigVerify {
+		if err := cf.verifySignature(gzipped, signature); err != nil {
+			return nil, fmt.Errorf("Cloud config failed signature verification: %s", err)
+		}
+	}
+
+	gzReader, err := gzip.NewReader(bytes.NewReader(gzipped))
 	if err != nil {
-		return nil, fmt.Errorf("Unable to construct request for cloud config at %s: %s", nocache, err)
+		return nil, fmt.Errorf("Unable to open gzip reader: %s", err)
+	}
+	decompressed, err := ioutil.ReadAll(gzReader)
+	if err != nil {
+		return nil, err
 	}
-	if cf.lastCloudConfigETag[url] != "" {
-		// Don't bother fetching if unchanged
-		req.Header.Set(ifNoneMatch, cf.lastCloudConfigETag[url])
+
+	env, err := parseEnvelope(decompressed)
+	if err != nil {
+		return nil, err
 	}
+	if env.Version <= cf.lastAppliedVersion {
+		log.Debugf("Ignoring cloud config with non-advancing version %d (have %d)", env.Version, cf.lastAppliedVersion)
+		return nil, nil
+	}
+	if !inRolloutBucket(cf.user.GetDeviceID(), env.RolloutBucket) {
+		log.Debugf("Device not in staged rollout bucket %d%%, skipping this config", env.RolloutBucket)
+		return nil, nil
+	}
+	cf.lastAppliedVersion = env.Version
+	analytics.SetOTLPConfig(env.OTLPEndpoint, env.OTLPSamplingRatio)
+	return decompressed, nil
+}
+
+// dohCloudConfigRecord and ipfsCloudConfigRecord are the TXT records the
+// "doh" and "ipfs" sources resolve through DoH, giving us two more
+// censorship-resistant rendezvous channels beyond the chained proxy and
+// fronted CDN, without needing any operator-supplied wiring.
+const (
+	dohCloudConfigRecord  = "_cloudconfig.getiantem.org"
+	ipfsCloudConfigRecord = "_cloudconfig-cid.getiantem.org"
+)
+
+// buildSources assembles the prioritized ConfigSource chain: the chained
+// proxy first, the domain-fronted CDN second, the DoH TXT and IPFS/CID
+// gateway rendezvous channels next, then any operator-registered sources,
+// and finally the on-disk cache as a fallback of last resort.
+func (cf *fetcher) buildSources(cfg *Config) []ConfigSource {
+	sources := []ConfigSource{
+		NewHTTPConfigSource("chained", cfg.CloudConfig, &legacyHeadersDoer{cf: cf}),
+	}
+	if cfg.FrontedCloudConfig != "" {
+		sources = append(sources, NewHTTPConfigSource("fronted", cfg.FrontedCloudConfig, &legacyHeadersDoer{cf: cf}))
+	}
+	dohClient := &http.Client{Timeout: 10 * time.Second}
+	sources = append(sources,
+		NewDoHConfigSource("doh", dohCloudConfigRecord, dohClient, resolveDoHTXT),
+		NewDoHConfigSource("ipfs", ipfsCloudConfigRecord, dohClient, resolveIPFSGatewayURL),
+	)
+	sources = append(sources, cf.extraSources...)
+	sources = append(sources, NewLocalCacheConfigSource())
+	return sources
+}
 
+// verifySignature parses and verifies a detached signature against the raw
+// (still-compressed) config bytes.
+func (cf *fetcher) verifySignature(gzipped, sigBytes []byte) error {
+	sig := &configSignature{}
+	if err := json.Unmarshal(sigBytes, sig); err != nil {
+		return fmt.Errorf("unable to parse signature: %v", err)
+	}
+	return sig.verify(gzipped)
+}
+
+// verifyResult is raceSources' accept callback: it gates a race winner on
+// signature verification (skipped for the local cache, which was already
+// verified once before being written to disk) so a source that wins the
+// race but fails verification doesn't abort the fetch -- raceSources falls
+// through to the next already-completed source instead.
+func (cf *fetcher) verifyResult(r *sourceResult) error {
+	if r.source == localCacheSourceName {
+		return nil
+	}
+	return cf.verifySignature(r.gzipped, r.signature)
+}
+
+// legacyHeadersDoer adapts cf.httpFetcher into an httpDoer while preserving
+// the request headers (user ID, pro token, cache-busting) the server has
+// always expected on a cloud config fetch.
+type legacyHeadersDoer struct {
+	cf *fetcher
+}
+
+func (d *legacyHeadersDoer) Do(req *http.Request) (*http.Response, error) {
 	req.Header.Set("Accept", "application/x-gzip")
 	// Prevents intermediate nodes (domain-fronters) from caching the content
 	req.Header.Set("Cache-Control", "no-cache")
-	// Set the fronted URL to lookup the config in parallel using chained and domain fronted servers.
-	req.Header.Set("Lantern-Fronted-URL", cfg.FrontedCloudConfig+cb)
 
-	id := cf.user.GetUserID()
-	if id != "" {
+	if id := d.cf.user.GetUserID(); id != "" {
 		req.Header.Set(userIDHeader, id)
 	}
-	tok := cf.user.GetToken()
-	if tok != "" {
+	if tok := d.cf.user.GetToken(); tok != "" {
 		req.Header.Set(tokenHeader, tok)
 	}
 
@@ -132,39 +371,49 @@ func (cf *fetcher) fetchCloudConfig(cfg *Config) ([]byte, error) {
 	// successive requests
 	req.Close = true
 
-	resp, err := cf.httpFetcher.Do(req)
+	resp, err := d.cf.httpFetcher.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to fetch cloud config at %s: %s", url, err)
+		return nil, err
 	}
-	dump, dumperr := httputil.DumpResponse(resp, false)
-	if dumperr != nil {
-		elog.Log(dumperr, errlog.WithOp("dump-response"))
-	} else {
+	if resp.Header.Get(streamingSupportedHeader) != "" {
+		d.cf.streamingSupported = true
+	}
+	if dump, dumperr := httputil.DumpResponse(resp, false); dumperr == nil {
 		log.Debugf("Response headers: \n%v", string(dump))
 	}
-	defer func() {
-		if closeerr := resp.Body.Close(); closeerr != nil {
-			log.Debugf("Error closing response body: %v", closeerr)
-		}
-	}()
+	return resp, nil
+}
 
-	if resp.StatusCode == 304 {
-		log.Debugf("Config unchanged in cloud")
-		return nil, nil
-	} else if resp.StatusCode != 200 {
-		if dumperr != nil {
-			return nil, fmt.Errorf("Bad config response code: %v", resp.StatusCode)
-		}
-		return nil, fmt.Errorf("Bad config resp:\n%v", string(dump))
+// pollViaStream blocks on the long-poll/SSE channel instead of sleeping for
+// CloudConfigPollInterval, for near-instant delivery of emergency config
+// rotations (e.g. new chained servers after the old ones get blocked). On
+// error it falls back to the regular poll loop with an exponential backoff
+// as the returned waitTime.
+func (cf *fetcher) pollViaStream(cfg *Config) (func(yamlconf.Config) error, time.Duration, error) {
+	noop := func(yamlconf.Config) error { return nil }
+
+	if cf.stream == nil {
+		cf.stream = newConfigStream(cfg.CloudConfig, &legacyHeadersDoer{cf: cf})
+	}
+	event, backoff, err := cf.stream.next(nil)
+	if err != nil {
+		log.Debugf("Config stream error, falling back to polling: %v", err)
+		cf.streamingSupported = false
+		return noop, backoff, nil
 	}
 
-	cf.lastCloudConfigETag[url] = resp.Header.Get(etag)
-	gzReader, err := gzip.NewReader(resp.Body)
+	decompressed, err := cf.acceptGzipped(event.data, event.signature, false)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to open gzip reader: %s", err)
+		elog.Log(err, errlog.WithOp("apply-streamed-config"))
+		return noop, 0, nil
+	}
+	if decompressed == nil {
+		return noop, 0, nil
+	}
+	if event.etag != "" {
+		cf.lastCloudConfigETag[cfg.CloudConfig] = event.etag
 	}
-	log.Debugf("Fetched cloud config")
-	return ioutil.ReadAll(gzReader)
+	return cf.applyConfig(decompressed), 0, nil
 }
 
 // cloudPollSleepTime adds some randomization to our requests to make them
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// streamingSupportedHeader is set by the server on a regular poll
+	// response to advertise that it also supports a streaming long-poll or
+	// SSE mode, so the client can switch over instead of continuing to poll
+	// every CloudConfigPollInterval.
+	streamingSupportedHeader = "X-Lantern-Config-Stream"
+
+	// longPollSuffix is appended to the full cloud config URL to reach the
+	// long-lived endpoint that blocks until a new config is available.
+	longPollSuffix = "/stream"
+
+	// streamMinBackoff and streamMaxBackoff bound the exponential backoff
+	// applied to the streaming connection after a disconnect or error,
+	// before we fall back to the regular poll loop.
+	streamMinBackoff = 1 * time.Second
+	streamMaxBackoff = 2 * time.Minute
+)
+
+// streamEvent is a single config update delivered over the long-poll/SSE
+// channel, carrying the same gzipped bytes and detached signature a regular
+// poll response would.
+type streamEvent struct {
+	etag      string
+	data      []byte
+	signature []byte
+}
+
+// configStream consumes a long-lived connection to the cloud config server,
+// either a blocking long-poll GET or a Server-Sent Events stream. Each call
+// to next returns one update, or an error and the backoff to wait before the
+// next attempt.
+type configStream struct {
+	url     string
+	client  httpDoer
+	backoff time.Duration
+}
+
+// newConfigStream creates a stream reader for url using client, which should
+// already be configured to dial via whatever transport the regular poll used
+// (chained proxy, fronted CDN, etc).
+func newConfigStream(url string, client httpDoer) *configStream {
+	return &configStream{url: url + longPollSuffix, client: client, backoff: streamMinBackoff}
+}
+
+// next blocks until the server delivers an update, the connection drops, or
+// stop is closed. On disconnect/error it returns a nil event and the caller
+// is expected to wait the returned backoff duration before retrying; repeat
+// failures double the backoff up to streamMaxBackoff, and a successful read
+// resets it.
+func (s *configStream) next(stop <-chan struct{}) (*streamEvent, time.Duration, error) {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return nil, s.nextBackoff(), err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, s.nextBackoff(), err
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			log.Debugf("Error closing config stream body: %v", closeErr)
+		}
+	}()
+	if resp.StatusCode != 200 {
+		return nil, s.nextBackoff(), fmt.Errorf("bad config stream response: %v", resp.StatusCode)
+	}
+
+	event, err := readSSEEvent(resp.Body, stop)
+	if err != nil {
+		return nil, s.nextBackoff(), err
+	}
+	s.backoff = streamMinBackoff
+	return event, 0, nil
+}
+
+func (s *configStream) nextBackoff() time.Duration {
+	wait := s.backoff
+	s.backoff *= 2
+	if s.backoff > streamMaxBackoff {
+		s.backoff = streamMaxBackoff
+	}
+	return wait
+}
+
+// readSSEEvent reads a single SSE event made up of "etag: ", "data: " (the
+// base64-encoded gzipped config) and "sig: " (its base64-encoded detached
+// signature) lines terminated by a blank line. A blank line with no data
+// line seen yet is a keep-alive, and causes this to keep reading for the
+// next real event rather than returning.
+func readSSEEvent(body interface {
+	Read([]byte) (int, error)
+}, stop <-chan struct{}) (*streamEvent, error) {
+	scanner := bufio.NewScanner(body)
+	var etagLine, dataLine, sigLine string
+	for scanner.Scan() {
+		select {
+		case <-stop:
+			return nil, fmt.Errorf("config stream stopped")
+		default:
+		}
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if dataLine == "" {
+				// keep-alive, keep reading for the next event
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(dataLine)
+			if err != nil {
+				return nil, fmt.Errorf("malformed config stream data: %v", err)
+			}
+			sig, err := base64.StdEncoding.DecodeString(sigLine)
+			if err != nil {
+				return nil, fmt.Errorf("malformed config stream signature: %v", err)
+			}
+			return &streamEvent{etag: etagLine, data: data, signature: sig}, nil
+		case strings.HasPrefix(line, "etag: "):
+			etagLine = strings.TrimPrefix(line, "etag: ")
+		case strings.HasPrefix(line, "data: "):
+			dataLine = strings.TrimPrefix(line, "data: ")
+		case strings.HasPrefix(line, "sig: "):
+			sigLine = strings.TrimPrefix(line, "sig: ")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("config stream closed")
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/getlantern/appdir"
+	"github.com/getlantern/yaml"
+)
+
+// lastGoodConfigPath is where the last config we successfully applied is
+// cached, so that we can roll back to it if a newly fetched config turns out
+// to be broken.
+var lastGoodConfigPath = filepath.Join(appdir.General("Lantern"), "cloud.yaml.gz.lastgood")
+
+// pendingMarkerPath records that a config was applied but not yet confirmed
+// healthy. Its mere presence at startup means the previous run exited
+// (crashed or otherwise) before confirming the config it had just applied,
+// so we roll back to the last-known-good one.
+var pendingMarkerPath = filepath.Join(appdir.General("Lantern"), "cloud.yaml.gz.pending")
+
+// configEnvelope captures the subset of fields we need to read out of a
+// fetched cloud config before handing the raw bytes to updateFrom. It's kept
+// intentionally minimal so that this package doesn't need to know about
+// every field Config declares.
+type configEnvelope struct {
+	Version       int64 `yaml:"version"`
+	RolloutBucket int   `yaml:"rolloutBucket"`
+
+	// OTLPEndpoint and OTLPSamplingRatio drive the OTLP analytics backend
+	// (see analytics.SetOTLPConfig) from the cloud config instead of a
+	// hard-coded default, so the collector endpoint and trace sampling rate
+	// can be changed without a client release. Either may be left zero-value
+	// to leave the corresponding setting unchanged.
+	OTLPEndpoint      string  `yaml:"otlpEndpoint"`
+	OTLPSamplingRatio float64 `yaml:"otlpSamplingRatio"`
+}
+
+// parseEnvelope extracts version/rollout metadata from a decompressed cloud
+// config so it can be checked before the config is applied.
+func parseEnvelope(decompressed []byte) (*configEnvelope, error) {
+	env := &configEnvelope{RolloutBucket: 100}
+	if err := yaml.Unmarshal(decompressed, env); err != nil {
+		return nil, fmt.Errorf("unable to parse cloud config envelope: %v", err)
+	}
+	return env, nil
+}
+
+// inRolloutBucket reports whether this device should apply a config staged
+// to the given rollout bucket. A bucket of 100 (or 0, treated as "not
+// staged") always matches.
+func inRolloutBucket(deviceID string, bucket int) bool {
+	if bucket <= 0 || bucket >= 100 {
+		return true
+	}
+	h := sha1.Sum([]byte(deviceID))
+	n := binary.BigEndian.Uint32(h[:4])
+	return int(n%100) < bucket
+}
+
+// saveLastGoodConfig persists the raw (decompressed) bytes of a config that
+// has been successfully applied, so it can be restored if a later config
+// fails.
+func saveLastGoodConfig(decompressed []byte) {
+	if err := ioutil.WriteFile(lastGoodConfigPath, decompressed, 0644); err != nil {
+		log.Debugf("Unable to persist last-known-good config: %v", err)
+	}
+}
+
+// loadLastGoodConfig returns the raw bytes of the last config known to have
+// applied cleanly, if any.
+func loadLastGoodConfig() ([]byte, error) {
+	bytes, err := ioutil.ReadFile(lastGoodConfigPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// markPending persists decompressed itself (not just a marker) as the
+// pending config -- applied but not yet confirmed healthy -- so that it, and
+// not whatever last confirmed-good config preceded it, is what's available
+// to promote if ConfirmHealthy is eventually called. Nothing promotes this
+// automatically: until ConfirmHealthy actually confirms the client can proxy
+// traffic, the marker stays set, and pendingRollbackNeeded will trigger a
+// rollback to the last-known-good config on the next startup. This is
+// deliberate -- "the process didn't crash" is not the same as "the config
+// works," and promoting on a bare timeout defeated the rollback this exists
+// for.
+func markPending(decompressed []byte) {
+	if err := ioutil.WriteFile(pendingMarkerPath, decompressed, 0644); err != nil {
+		log.Debugf("Unable to write pending config marker: %v", err)
+	}
+}
+
+// promotePendingToLastGood saves whatever's currently marked pending as the
+// new last-known-good config and clears the marker. Called by ConfirmHealthy
+// once the client has confirmed the currently applied config actually works.
+func promotePendingToLastGood() {
+	if pending, err := ioutil.ReadFile(pendingMarkerPath); err == nil {
+		saveLastGoodConfig(pending)
+	} else {
+		log.Debugf("No pending config to promote to last-known-good: %v", err)
+	}
+	clearPendingMarker()
+}
+
+// clearPendingMarker removes the pending marker, indicating the currently
+// applied config is healthy.
+func clearPendingMarker() {
+	if err := os.Remove(pendingMarkerPath); err != nil && !os.IsNotExist(err) {
+		log.Debugf("Unable to clear pending config marker: %v", err)
+	}
+}
+
+// pendingRollbackNeeded reports whether the previous run applied a config it
+// never confirmed healthy (see ConfirmHealthy), meaning the fetcher should
+// roll back to last-known-good before fetching anything new.
+func pendingRollbackNeeded() bool {
+	_, err := os.Stat(pendingMarkerPath)
+	return err == nil
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withTempConfigPaths points lastGoodConfigPath/pendingMarkerPath at a fresh
+// temp directory for the duration of a test, restoring the originals after.
+func withTempConfigPaths(t *testing.T) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "lantern-config-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	origGood, origPending := lastGoodConfigPath, pendingMarkerPath
+	lastGoodConfigPath = filepath.Join(dir, "cloud.yaml.gz.lastgood")
+	pendingMarkerPath = filepath.Join(dir, "cloud.yaml.gz.pending")
+	t.Cleanup(func() {
+		lastGoodConfigPath, pendingMarkerPath = origGood, origPending
+		os.RemoveAll(dir)
+	})
+}
+
+func TestPendingRollbackNeeded(t *testing.T) {
+	withTempConfigPaths(t)
+
+	if pendingRollbackNeeded() {
+		t.Fatalf("expected no rollback needed before any config has been applied")
+	}
+
+	markPending([]byte("v2"))
+	if !pendingRollbackNeeded() {
+		t.Fatalf("expected rollback needed once a config is applied but not yet confirmed healthy")
+	}
+}
+
+func TestMarkPendingNeverAutoPromotes(t *testing.T) {
+	withTempConfigPaths(t)
+
+	markPending([]byte("v2"))
+
+	// Unlike the old (buggy) behavior, nothing should promote this config to
+	// last-known-good on its own just because the process kept running --
+	// only an explicit ConfirmHealthy call may do that.
+	if good, err := loadLastGoodConfig(); err != nil || good != nil {
+		t.Fatalf("expected no last-known-good config until ConfirmHealthy is called, got %q (err=%v)", good, err)
+	}
+	if !pendingRollbackNeeded() {
+		t.Fatalf("expected the pending marker to remain set until ConfirmHealthy is called")
+	}
+}
+
+func TestConfirmHealthyPromotesPendingAndClearsMarker(t *testing.T) {
+	withTempConfigPaths(t)
+
+	markPending([]byte("v2"))
+	ConfirmHealthy()
+
+	if pendingRollbackNeeded() {
+		t.Fatalf("expected ConfirmHealthy to clear the pending marker")
+	}
+	good, err := loadLastGoodConfig()
+	if err != nil {
+		t.Fatalf("loadLastGoodConfig failed: %v", err)
+	}
+	if string(good) != "v2" {
+		t.Fatalf("expected ConfirmHealthy to promote the pending config to last-known-good, got %q", good)
+	}
+}
+
+func TestConfirmHealthyWithNoPendingConfigIsANoOp(t *testing.T) {
+	withTempConfigPaths(t)
+
+	saveLastGoodConfig([]byte("v1"))
+	ConfirmHealthy()
+
+	good, err := loadLastGoodConfig()
+	if err != nil {
+		t.Fatalf("loadLastGoodConfig failed: %v", err)
+	}
+	if string(good) != "v1" {
+		t.Fatalf("expected ConfirmHealthy with nothing pending to leave last-known-good untouched, got %q", good)
+	}
+}
+
+func TestInRolloutBucket(t *testing.T) {
+	if !inRolloutBucket("any-device", 0) {
+		t.Fatalf("expected bucket 0 to always match (not staged)")
+	}
+	if !inRolloutBucket("any-device", 100) {
+		t.Fatalf("expected bucket 100 to always match (fully rolled out)")
+	}
+	// Rollout is a monotonic expansion of the same per-device hash, not an
+	// independent coin flip per bucket size -- a device in a narrower bucket
+	// must also be in every wider one.
+	for _, deviceID := range []string{"device-a", "device-b", "device-c", "device-d"} {
+		if inRolloutBucket(deviceID, 10) && !inRolloutBucket(deviceID, 50) {
+			t.Fatalf("expected a device in the 10%% bucket to also be in the 50%% bucket")
+		}
+	}
+}
+
+func TestParseEnvelope(t *testing.T) {
+	env, err := parseEnvelope([]byte("version: 3\nrolloutBucket: 25\notlpEndpoint: collector:4317\notlpSamplingRatio: 0.5\n"))
+	if err != nil {
+		t.Fatalf("parseEnvelope failed: %v", err)
+	}
+	if env.Version != 3 || env.RolloutBucket != 25 {
+		t.Fatalf("unexpected envelope fields: %+v", env)
+	}
+	if env.OTLPEndpoint != "collector:4317" || env.OTLPSamplingRatio != 0.5 {
+		t.Fatalf("unexpected OTLP envelope fields: %+v", env)
+	}
+}
+
+func TestParseEnvelopeDefaultsRolloutBucketTo100(t *testing.T) {
+	env, err := parseEnvelope([]byte("version: 1\n"))
+	if err != nil {
+		t.Fatalf("parseEnvelope failed: %v", err)
+	}
+	if env.RolloutBucket != 100 {
+		t.Fatalf("expected a config with no rolloutBucket field to default to 100, got %d", env.RolloutBucket)
+	}
+}
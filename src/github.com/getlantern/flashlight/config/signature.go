@@ -0,0 +1,45 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+)
+
+// trustedConfigKeys maps a public-key-id (as advertised in the signature
+// header) to the Ed25519 public key used to verify it. Keys are rotated by
+// adding a new entry here; old entries are kept around long enough for
+// in-the-wild clients to pick up the new signer.
+var trustedConfigKeys = map[string]ed25519.PublicKey{}
+
+// RegisterTrustedKey adds a public key that fetchCloudConfig will accept
+// signatures from, keyed by the id the server advertises alongside the
+// signature. Intended to be called from init() in a build-specific file that
+// embeds the real production keys.
+func RegisterTrustedKey(keyID string, publicKey ed25519.PublicKey) {
+	trustedConfigKeys[keyID] = publicKey
+}
+
+// configSignature is the detached signature served alongside cloud.yaml.gz,
+// typically as cloud.yaml.gz.sig.
+type configSignature struct {
+	KeyID     string `json:"keyId"`
+	Signature string `json:"signature"`
+}
+
+// verify checks sig against data using the registered trusted key. It
+// returns an error if the key is unknown or the signature doesn't match.
+func (sig *configSignature) verify(data []byte) error {
+	key, ok := trustedConfigKeys[sig.KeyID]
+	if !ok {
+		return fmt.Errorf("unknown config signing key id: %v", sig.KeyID)
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		return fmt.Errorf("malformed config signature: %v", err)
+	}
+	if !ed25519.Verify(key, data, raw) {
+		return fmt.Errorf("config signature does not verify against key %v", sig.KeyID)
+	}
+	return nil
+}
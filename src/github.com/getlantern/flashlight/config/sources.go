@@ -0,0 +1,366 @@
+package config
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/getlantern/flashlight/analytics"
+)
+
+// localCacheSourceName identifies NewLocalCacheConfigSource's source so
+// fetchCloudConfig can recognize it and skip signature verification, since a
+// cached config was already verified once before it was written to disk.
+const localCacheSourceName = "local-cache"
+
+// ConfigSource is one way of retrieving the raw (gzipped) cloud config bytes
+// and its detached signature. Implementations range from a plain HTTP fetch
+// through a chained proxy to censorship-resistant rendezvous channels like
+// DNS-over-HTTPS or an IPFS gateway.
+type ConfigSource interface {
+	// Name identifies the source for logging and success-rate tracking.
+	Name() string
+	// Fetch retrieves the gzipped config and its signature bytes, or an
+	// error if this source couldn't produce them. notModified is true if
+	// the source confirmed the config is unchanged since etag, in which
+	// case newETag is the etag the source reported with that answer, if
+	// any. Sources that have no concept
+	// of etags (e.g. the local cache) may always report notModified=false.
+	Fetch(etag string) (gzipped []byte, signature []byte, notModified bool, newETag string, err error)
+}
+
+// sourceRanking tracks a rolling success rate per ConfigSource so that
+// historically reliable sources are tried first on the next fetch.
+type sourceRanking struct {
+	mu    sync.Mutex
+	stats map[string]*sourceStats
+}
+
+type sourceStats struct {
+	attempts  int
+	successes int
+}
+
+func newSourceRanking() *sourceRanking {
+	return &sourceRanking{stats: map[string]*sourceStats{}}
+}
+
+func (r *sourceRanking) record(name string, success bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.stats[name]
+	if !ok {
+		s = &sourceStats{}
+		r.stats[name] = s
+	}
+	s.attempts++
+	if success {
+		s.successes++
+	}
+}
+
+// successRate returns this source's historical success rate. Unseen sources
+// default to 1.0 so they get a fair first try.
+func (r *sourceRanking) successRate(name string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.stats[name]
+	if !ok || s.attempts == 0 {
+		return 1.0
+	}
+	return float64(s.successes) / float64(s.attempts)
+}
+
+// order returns sources sorted by descending historical success rate, with
+// ties broken by keeping the original (priority) order stable.
+func (r *sourceRanking) order(sources []ConfigSource) []ConfigSource {
+	ordered := make([]ConfigSource, len(sources))
+	copy(ordered, sources)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return r.successRate(ordered[i].Name()) > r.successRate(ordered[j].Name())
+	})
+	return ordered
+}
+
+// sourceResult is a single ConfigSource's outcome, used internally by
+// raceSources.
+type sourceResult struct {
+	source      string
+	gzipped     []byte
+	signature   []byte
+	notModified bool
+	newETag     string
+	err         error
+}
+
+// happyEyeballsStagger is how long we wait before starting the next source
+// in priority order while still waiting on earlier ones, Happy-Eyeballs
+// style, so a slow or blocked primary source doesn't add its full timeout to
+// every fetch.
+const happyEyeballsStagger = 500 * time.Millisecond
+
+// raceSources tries sources in order of historical success rate, staggering
+// starts so that a fast fallback can win even if a higher-priority source is
+// still in flight, and returns the first response that succeeds (or
+// confirms not-modified) and, if accept is given, passes accept. A result
+// that fails accept (e.g. a bad signature) is treated like any other source
+// failure: it's recorded against that source's ranking and the race moves
+// on to the next already-in-flight or still-pending result, instead of
+// failing the whole fetch over one bad actor. All in-flight sources are
+// recorded for ranking even after a winner returns.
+func raceSources(sources []ConfigSource, ranking *sourceRanking, etag string, accept func(*sourceResult) error) (*sourceResult, error) {
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no config sources configured")
+	}
+	ordered := ranking.order(sources)
+
+	results := make(chan *sourceResult, len(ordered))
+	for i, src := range ordered {
+		delay := time.Duration(i) * happyEyeballsStagger
+		go func(src ConfigSource, delay time.Duration) {
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+			dialStart := time.Now()
+			gzipped, sig, notModified, newETag, err := src.Fetch(etag)
+			analytics.RecordProxyDialLatency(src.Name(), time.Since(dialStart))
+			ranking.record(src.Name(), err == nil)
+			results <- &sourceResult{source: src.Name(), gzipped: gzipped, signature: sig, notModified: notModified, newETag: newETag, err: err}
+		}(src, delay)
+	}
+
+	var lastErr error
+	for i := 0; i < len(ordered); i++ {
+		r := <-results
+		if r.err != nil {
+			log.Debugf("Config source %v failed: %v", r.source, r.err)
+			lastErr = r.err
+			continue
+		}
+		if accept != nil && !r.notModified {
+			if err := accept(r); err != nil {
+				log.Debugf("Config source %v produced an unacceptable result: %v", r.source, err)
+				ranking.record(r.source, false)
+				lastErr = err
+				continue
+			}
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("all config sources failed, last error: %v", lastErr)
+}
+
+// httpDoer is satisfied by both *http.Client and util.HTTPFetcher, letting
+// httpConfigSource work whether a source dials directly or through Lantern's
+// own chained/fronted transport.
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// httpConfigSource fetches the config over a plain HTTP GET, optionally
+// through a local proxy (e.g. a chained server or the fronted CDN host via
+// domain fronting). client is expected to already be configured to dial
+// through whatever channel this source represents.
+type httpConfigSource struct {
+	name   string
+	url    string
+	client httpDoer
+}
+
+// NewHTTPConfigSource creates a ConfigSource that fetches url using client,
+// e.g. an http.Client dialing through a chained proxy or a domain-fronted
+// CDN.
+func NewHTTPConfigSource(name, url string, client httpDoer) ConfigSource {
+	return &httpConfigSource{name: name, url: url, client: client}
+}
+
+func (s *httpConfigSource) Name() string { return s.name }
+
+func (s *httpConfigSource) Fetch(etag string) ([]byte, []byte, bool, string, error) {
+	gzipped, notModified, newETag, err := s.get(s.url, etag)
+	if err != nil || notModified {
+		return nil, nil, notModified, newETag, err
+	}
+	sig, _, _, err := s.get(s.url+signatureSuffix, "")
+	if err != nil {
+		return nil, nil, false, "", err
+	}
+	return gzipped, sig, false, newETag, nil
+}
+
+// dohConfigSource resolves a DNS-over-HTTPS TXT record whose value points to
+// where the current cloud config lives (a URL, or a CID that resolve turns
+// into a gateway URL). It's meant as a rendezvous channel that
+// survives straightforward DNS and IP blocking, resolved through doHClient
+// (itself typically just a plain HTTPS client, since DoH runs over 443 to a
+// well-known resolver).
+type dohConfigSource struct {
+	name       string
+	recordName string
+	doHClient  *http.Client
+	resolve    func(client *http.Client, recordName string) (configURL string, err error)
+	inner      func(url string) ConfigSource
+}
+
+// NewDoHConfigSource creates a ConfigSource that looks up recordName via a
+// DNS-over-HTTPS TXT query using doHClient, then fetches the config from the
+// URL the record points to.
+func NewDoHConfigSource(name, recordName string, doHClient *http.Client, resolve func(*http.Client, string) (string, error)) ConfigSource {
+	return &dohConfigSource{
+		name:       name,
+		recordName: recordName,
+		doHClient:  doHClient,
+		resolve:    resolve,
+		inner:      func(url string) ConfigSource { return NewHTTPConfigSource(name, url, doHClient) },
+	}
+}
+
+func (s *dohConfigSource) Name() string { return s.name }
+
+func (s *dohConfigSource) Fetch(etag string) ([]byte, []byte, bool, string, error) {
+	configURL, err := s.resolve(s.doHClient, s.recordName)
+	if err != nil {
+		return nil, nil, false, "", fmt.Errorf("unable to resolve %v over DoH: %v", s.recordName, err)
+	}
+	return s.inner(configURL).Fetch(etag)
+}
+
+// dohResolverURL is the DoH-over-HTTPS resolver queried by resolveDoHTXT and
+// resolveIPFSGatewayURL. It's a well-known, widely-reachable endpoint so this
+// lookup itself isn't an easy censorship target.
+const dohResolverURL = "https://cloudflare-dns.com/dns-query"
+
+// dohAnswer is the subset of Google/Cloudflare's DoH JSON response format
+// (RFC 8427-ish, application/dns-json) that resolveDoHTXT needs.
+type dohAnswer struct {
+	Answer []struct {
+		Data string `json:"data"`
+	} `json:"Answer"`
+}
+
+// resolveDoHTXT looks up recordName's TXT record over DoH and returns its
+// value verbatim, treating it as the config URL to fetch from. It's the
+// default resolve function for the "doh" source in buildSources.
+func resolveDoHTXT(client *http.Client, recordName string) (string, error) {
+	req, err := http.NewRequest("GET", dohResolverURL+"?name="+url.QueryEscape(recordName)+"&type=TXT", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			log.Debugf("Error closing DoH response body: %v", closeErr)
+		}
+	}()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("DoH query for %v failed with status %v", recordName, resp.StatusCode)
+	}
+	var parsed dohAnswer
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return "", fmt.Errorf("unable to parse DoH response for %v: %v", recordName, err)
+	}
+	if len(parsed.Answer) == 0 {
+		return "", fmt.Errorf("no TXT record found for %v", recordName)
+	}
+	// TXT record values come back double-quoted.
+	return strings.Trim(parsed.Answer[0].Data, `"`), nil
+}
+
+// ipfsGatewayURL is the public IPFS gateway used to fetch the config once its
+// CID has been resolved. Any of the well-known public gateways would do; the
+// censorship-resistance here comes from the gateway being one of many widely
+// used for unrelated content, not from this specific host.
+const ipfsGatewayURL = "https://ipfs.io/ipfs/"
+
+// resolveIPFSGatewayURL resolves recordName the same way resolveDoHTXT does,
+// but treats the TXT value as a bare IPFS CID (which changes every time the
+// config is republished) rather than a URL, and turns it into a fetchable
+// gateway URL. It's the resolve function for the "ipfs" source in
+// buildSources.
+func resolveIPFSGatewayURL(client *http.Client, recordName string) (string, error) {
+	cid, err := resolveDoHTXT(client, recordName)
+	if err != nil {
+		return "", err
+	}
+	return ipfsGatewayURL + cid, nil
+}
+
+// localCacheConfigSource serves the last-known-good config from disk. It
+// reports an error only if nothing is cached yet or the cache can't be read,
+// making it a safe last resort in the source list.
+type localCacheConfigSource struct {
+	name string
+}
+
+// NewLocalCacheConfigSource creates a ConfigSource that falls back to the
+// last-known-good config persisted on disk, for use as the lowest-priority
+// entry in a source chain.
+func NewLocalCacheConfigSource() ConfigSource {
+	return &localCacheConfigSource{name: localCacheSourceName}
+}
+
+func (s *localCacheConfigSource) Name() string { return s.name }
+
+func (s *localCacheConfigSource) Fetch(etag string) ([]byte, []byte, bool, string, error) {
+	good, err := loadLastGoodConfig()
+	if err != nil {
+		return nil, nil, false, "", err
+	}
+	if good == nil {
+		return nil, nil, false, "", fmt.Errorf("no cached config available")
+	}
+	// The cached config was already verified and applied once; no signature
+	// accompanies it, and verifyResult skips verification for this source.
+	// The cache holds the decompressed config, so it's gzipped again here to
+	// match what every other source returns.
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(good); err != nil {
+		return nil, nil, false, "", err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, nil, false, "", err
+	}
+	return buf.Bytes(), nil, false, "", nil
+}
+
+func (s *httpConfigSource) get(url, ifMatchEtag string) ([]byte, bool, string, error) {
+	req, err := http.NewRequest("GET", url+"?"+uuid.New(), nil)
+	if err != nil {
+		return nil, false, "", err
+	}
+	if ifMatchEtag != "" {
+		req.Header.Set(ifNoneMatch, ifMatchEtag)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, false, "", err
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			log.Debugf("Error closing response body from %v: %v", url, closeErr)
+		}
+	}()
+	newETag := resp.Header.Get(etag)
+	if resp.StatusCode == 304 {
+		return nil, true, newETag, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, false, "", fmt.Errorf("bad response from %v: %v", url, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	return body, false, newETag, err
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+)
+
+// stubSource is a hand-rolled ConfigSource for exercising raceSources without
+// touching the network.
+type stubSource struct {
+	name    string
+	gzipped []byte
+	err     error
+}
+
+func (s *stubSource) Name() string { return s.name }
+
+func (s *stubSource) Fetch(etag string) ([]byte, []byte, bool, string, error) {
+	if s.err != nil {
+		return nil, nil, false, "", s.err
+	}
+	return s.gzipped, []byte("sig-" + s.name), false, "", nil
+}
+
+func acceptByGzippedString(want string) func(*sourceResult) error {
+	return func(r *sourceResult) error {
+		if string(r.gzipped) != want {
+			return fmt.Errorf("rejected result from %v", r.source)
+		}
+		return nil
+	}
+}
+
+func TestRaceSourcesFallsThroughOnRejectedWinner(t *testing.T) {
+	sources := []ConfigSource{
+		&stubSource{name: "bad", gzipped: []byte("tampered")},
+		&stubSource{name: "good", gzipped: []byte("trusted")},
+	}
+
+	result, err := raceSources(sources, newSourceRanking(), "", acceptByGzippedString("trusted"))
+	if err != nil {
+		t.Fatalf("raceSources failed: %v", err)
+	}
+	if result.source != "good" {
+		t.Fatalf("expected the race to fall through to the accepted source, got %v", result.source)
+	}
+}
+
+func TestRaceSourcesFailsWhenAllSourcesRejected(t *testing.T) {
+	sources := []ConfigSource{
+		&stubSource{name: "bad-1", gzipped: []byte("tampered-1")},
+		&stubSource{name: "bad-2", gzipped: []byte("tampered-2")},
+	}
+
+	if _, err := raceSources(sources, newSourceRanking(), "", acceptByGzippedString("trusted")); err == nil {
+		t.Fatalf("expected raceSources to fail when every source is rejected by accept")
+	}
+}
+
+func TestRaceSourcesSkipsFailedSources(t *testing.T) {
+	sources := []ConfigSource{
+		&stubSource{name: "broken", err: fmt.Errorf("connection refused")},
+		&stubSource{name: "working", gzipped: []byte("trusted")},
+	}
+
+	result, err := raceSources(sources, newSourceRanking(), "", acceptByGzippedString("trusted"))
+	if err != nil {
+		t.Fatalf("raceSources failed: %v", err)
+	}
+	if result.source != "working" {
+		t.Fatalf("expected raceSources to skip the failed source, got %v", result.source)
+	}
+}
+
+func TestRaceSourcesWithNoAcceptReturnsFirstSuccess(t *testing.T) {
+	sources := []ConfigSource{
+		&stubSource{name: "only", gzipped: []byte("config")},
+	}
+
+	result, err := raceSources(sources, newSourceRanking(), "", nil)
+	if err != nil {
+		t.Fatalf("raceSources failed: %v", err)
+	}
+	if result.source != "only" || string(result.gzipped) != "config" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}